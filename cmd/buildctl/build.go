@@ -4,8 +4,10 @@ import (
 	"context"
 	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/containerd/console"
@@ -25,6 +27,15 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// cacheImportTypes and cacheExportTypes list the cache backends understood by --import-cache/--export-cache.
+var (
+	cacheImportTypes = map[string]bool{"registry": true, "local": true}
+	cacheExportTypes = map[string]bool{"registry": true, "local": true, "inline": true}
+)
+
+// traceFormats lists the values accepted by --trace-format.
+var traceFormats = map[string]bool{"raw": true, "jaeger": true, "otlp-json": true}
+
 var buildCommand = cli.Command{
 	Name:   "build",
 	Usage:  "build",
@@ -40,13 +51,22 @@ var buildCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:  "progress",
-			Usage: "Set type of progress (auto, plain, tty). Use plain to show container output",
+			Usage: "Set type of progress (auto, plain, tty, json, rawjson). Use plain to show container output, json/rawjson to stream machine-readable events to stdout",
 			Value: "auto",
 		},
+		cli.StringFlag{
+			Name:  "metrics-push",
+			Usage: "Push build metrics (vertex count, duration, cache-hit ratio, bytes transferred) to a Prometheus pushgateway URL at the end of the build",
+		},
 		cli.StringFlag{
 			Name:  "trace",
 			Usage: "Path to trace file. Defaults to no tracing.",
 		},
+		cli.StringFlag{
+			Name:  "trace-format",
+			Usage: "Trace file format: raw (json-lines of client.SolveStatus), jaeger or otlp-json",
+			Value: "raw",
+		},
 		cli.StringSliceFlag{
 			Name:  "local",
 			Usage: "Allow build access to the local directory",
@@ -59,13 +79,17 @@ var buildCommand = cli.Command{
 			Name:  "frontend-opt",
 			Usage: "Define custom options for frontend",
 		},
+		cli.StringSliceFlag{
+			Name:  "build-context",
+			Usage: "Define additional named context, e.g. name=docker-image://ref, name=oci-layout://path, name=./local/dir or name=https://host/repo.git. Requires --frontend",
+		},
 		cli.BoolFlag{
 			Name:  "no-cache",
 			Usage: "Disable cache for all the vertices",
 		},
 		cli.StringSliceFlag{
 			Name:  "export-cache",
-			Usage: "Export build cache, e.g. type=registry,ref=example.com/foo/bar, or type=local,store=path/to/dir",
+			Usage: "Export build cache, e.g. type=registry,ref=example.com/foo/bar, or type=local,dest=path/to/dir",
 		},
 		cli.StringSliceFlag{
 			Name:   "export-cache-opt",
@@ -74,11 +98,19 @@ var buildCommand = cli.Command{
 		},
 		cli.StringSliceFlag{
 			Name:  "import-cache",
-			Usage: "Import build cache",
+			Usage: "Import build cache, e.g. type=registry,ref=example.com/foo/bar, or type=local,src=path/to/dir",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Usage: "Shorthand for --import-cache type=registry,ref=<ref>",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-to",
+			Usage: "Shorthand for --export-cache type=registry,ref=<ref>[,mode=max]. Also accepts type=inline,<opt>=<optval>",
 		},
 		cli.StringSliceFlag{
 			Name:  "secret",
-			Usage: "Secret value exposed to the build. Format id=secretname,src=filepath",
+			Usage: "Secret value exposed to the build. Format id=secretname,src=filepath or type=env,id=secretname,env=VARNAME. Bare id=FOO defaults to reading $FOO",
 		},
 		cli.StringSliceFlag{
 			Name:  "allow",
@@ -115,9 +147,14 @@ func read(r io.Reader, clicontext *cli.Context) (*llb.Definition, error) {
 	return def, nil
 }
 
-func openTraceFile(clicontext *cli.Context) (*os.File, error) {
+// openTraceFile opens the --trace file for writing, appending for raw and truncating for buffered formats.
+func openTraceFile(clicontext *cli.Context, traceFormat string) (*os.File, error) {
 	if traceFileName := clicontext.String("trace"); traceFileName != "" {
-		return os.OpenFile(traceFileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+		if traceFormat != "raw" {
+			flags = os.O_TRUNC | os.O_CREATE | os.O_WRONLY
+		}
+		return os.OpenFile(traceFileName, flags, 0600)
 	}
 	return nil, nil
 }
@@ -128,16 +165,22 @@ func build(clicontext *cli.Context) error {
 		return err
 	}
 
-	traceFile, err := openTraceFile(clicontext)
+	traceFormat := clicontext.String("trace-format")
+	if !traceFormats[traceFormat] {
+		return errors.Errorf("invalid trace-format: %s", traceFormat)
+	}
+	traceFile, err := openTraceFile(clicontext, traceFormat)
 	if err != nil {
 		return err
 	}
 	var traceEnc *json.Encoder
 	if traceFile != nil {
 		defer traceFile.Close()
-		traceEnc = json.NewEncoder(traceFile)
+		if traceFormat == "raw" {
+			traceEnc = json.NewEncoder(traceFile)
+		}
 
-		logrus.Infof("tracing logs to %s", traceFile.Name())
+		logrus.Infof("tracing logs to %s (format=%s)", traceFile.Name(), traceFormat)
 	}
 
 	attachable := []session.Attachable{authprovider.NewDockerAuthProvider()}
@@ -176,6 +219,31 @@ func build(clicontext *cli.Context) error {
 		return err
 	}
 
+	for _, from := range clicontext.StringSlice("cache-from") {
+		im, err := parseCacheFromFlag(from)
+		if err != nil {
+			return errors.Wrap(err, "invalid cache-from")
+		}
+		cacheImports = append(cacheImports, im)
+	}
+	for _, to := range clicontext.StringSlice("cache-to") {
+		ex, err := parseCacheToFlag(to)
+		if err != nil {
+			return errors.Wrap(err, "invalid cache-to")
+		}
+		cacheExports = append(cacheExports, ex)
+	}
+	for _, ex := range cacheExports {
+		if ex.Type == "inline" && clicontext.String("exporter") != client.ExporterImage {
+			return errors.New("cache exporter type=inline requires --exporter=image")
+		}
+	}
+
+	localCacheDirs, err := resolveCacheLocalDirs(cacheExports, cacheImports)
+	if err != nil {
+		return err
+	}
+
 	ch := make(chan *client.SolveStatus)
 	eg, ctx := errgroup.WithContext(commandContext(clicontext))
 
@@ -211,6 +279,30 @@ func build(clicontext *cli.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "invalid local")
 	}
+	// Merge into the same LocalDirs map (and therefore the same FSSync
+	// session) that --local populates: client.Solve already attaches a
+	// filesync.NewFSSyncProvider for solveOpt.LocalDirs itself, and
+	// registering a second one on the same session crashes grpc-go's
+	// Server.RegisterService.
+	for name, dir := range localCacheDirs {
+		solveOpt.LocalDirs[name] = dir
+	}
+
+	if buildContexts := clicontext.StringSlice("build-context"); len(buildContexts) > 0 {
+		if solveOpt.Frontend == "" {
+			return errors.New("--build-context requires --frontend to be set")
+		}
+		contextLocalDirs, contextFrontendAttrs, err := parseBuildContexts(buildContexts)
+		if err != nil {
+			return errors.Wrap(err, "invalid build-context")
+		}
+		for k, v := range contextLocalDirs {
+			solveOpt.LocalDirs[k] = v
+		}
+		for k, v := range contextFrontendAttrs {
+			solveOpt.FrontendAttrs[k] = v
+		}
+	}
 
 	var def *llb.Definition
 	if clicontext.String("frontend") == "" {
@@ -241,42 +333,118 @@ func build(clicontext *cli.Context) error {
 		return err
 	})
 
-	displayCh := ch
-	if traceEnc != nil {
-		displayCh = make(chan *client.SolveStatus)
+	// Every sink below (the progress display, the trace file, and
+	// --metrics-push) needs to see the full event stream independently, so
+	// fan ch out to one channel per sink instead of threading them through
+	// each other.
+	metricsPushURL := clicontext.String("metrics-push")
+	numSinks := 1 // progress
+	if traceFile != nil {
+		numSinks++
+	}
+	if metricsPushURL != "" {
+		numSinks++
+	}
+	sinkChs := fanOutSolveStatus(ctx, ch, numSinks)
+	progressCh := sinkChs[0]
+	sinkChs = sinkChs[1:]
+
+	if traceFile != nil {
+		traceCh := sinkChs[0]
+		sinkChs = sinkChs[1:]
 		eg.Go(func() error {
-			defer close(displayCh)
-			for s := range ch {
-				if err := traceEnc.Encode(s); err != nil {
-					logrus.Error(err)
+			var buffered []*client.SolveStatus
+			for s := range traceCh {
+				if traceEnc != nil {
+					if err := traceEnc.Encode(s); err != nil {
+						logrus.Error(err)
+					}
+				} else {
+					buffered = append(buffered, s)
 				}
-				displayCh <- s
+			}
+			if traceEnc == nil {
+				return writeTrace(traceFile, traceFormat, buffered)
 			}
 			return nil
 		})
 	}
 
+	if metricsPushURL != "" {
+		metricsCh := sinkChs[0]
+		sinkChs = sinkChs[1:]
+		eg.Go(func() error {
+			return pushMetrics(metricsPushURL, metricsCh)
+		})
+	}
+
 	eg.Go(func() error {
-		var c console.Console
-		progressOpt := clicontext.String("progress")
+		return runProgress(clicontext, progressCh)
+	})
 
-		switch progressOpt {
-		case "auto", "tty":
+	return eg.Wait()
+}
+
+// runProgress renders the solve status stream according to --progress.
+func runProgress(clicontext *cli.Context, ch chan *client.SolveStatus) error {
+	progressOpt := clicontext.String("progress")
+	switch progressOpt {
+	case "auto", "tty", "plain":
+		var c console.Console
+		if progressOpt != "plain" {
 			cf, err := console.ConsoleFromFile(os.Stderr)
 			if err != nil && progressOpt == "tty" {
 				return err
 			}
 			c = cf
-		case "plain":
-		default:
-			return errors.Errorf("invalid progress value : %s", progressOpt)
 		}
-
 		// not using shared context to not disrupt display but let is finish reporting errors
-		return progressui.DisplaySolveStatus(context.TODO(), "", c, os.Stdout, displayCh)
-	})
+		return progressui.DisplaySolveStatus(context.TODO(), "", c, os.Stdout, ch)
+	case "json":
+		return writeJSONProgress(os.Stdout, ch)
+	case "rawjson":
+		enc := json.NewEncoder(os.Stdout)
+		for s := range ch {
+			if err := enc.Encode(s); err != nil {
+				logrus.Error(err)
+			}
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid progress value : %s", progressOpt)
+	}
+}
 
-	return eg.Wait()
+// fanOutSolveStatus copies every event from ch to n independent channels, each send racing ctx.Done.
+func fanOutSolveStatus(ctx context.Context, ch chan *client.SolveStatus, n int) []chan *client.SolveStatus {
+	outs := make([]chan *client.SolveStatus, n)
+	for i := range outs {
+		outs[i] = make(chan *client.SolveStatus)
+	}
+	go func() {
+		defer func() {
+			for _, o := range outs {
+				close(o)
+			}
+		}()
+		for {
+			select {
+			case s, ok := <-ch:
+				if !ok {
+					return
+				}
+				for _, o := range outs {
+					select {
+					case o <- s:
+					case <-ctx.Done():
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return outs
 }
 
 func parseExportCacheCSV(s string) (client.CacheOptionsEntry, error) {
@@ -303,8 +471,13 @@ func parseExportCacheCSV(s string) (client.CacheOptionsEntry, error) {
 	if ex.Type == "" {
 		return ex, errors.New("--export-cache requires type=<type>")
 	}
-	if _, ok := ex.Attrs["mode"]; !ok {
-		ex.Attrs["mode"] = "min"
+	if !cacheExportTypes[ex.Type] {
+		return ex, errors.Errorf("unsupported cache exporter type: %s", ex.Type)
+	}
+	if ex.Type != "inline" {
+		if _, ok := ex.Attrs["mode"]; !ok {
+			ex.Attrs["mode"] = "min"
+		}
 	}
 	return ex, nil
 }
@@ -371,6 +544,9 @@ func parseImportCacheCSV(s string) (client.CacheOptionsEntry, error) {
 	if im.Type == "" {
 		return im, errors.New("--import-cache requires type=<type>")
 	}
+	if !cacheImportTypes[im.Type] {
+		return im, errors.Errorf("unsupported cache importer type: %s", im.Type)
+	}
 	return im, nil
 }
 
@@ -395,6 +571,91 @@ func parseImportCache(importCaches []string) ([]client.CacheOptionsEntry, error)
 	return imports, nil
 }
 
+// parseCacheFromFlag expands the --cache-from shorthand into a registry-typed CacheOptionsEntry.
+func parseCacheFromFlag(s string) (client.CacheOptionsEntry, error) {
+	if strings.Contains(s, "type=") {
+		return parseImportCacheCSV(s)
+	}
+	return parseImportCacheCSV("type=registry,ref=" + s)
+}
+
+// parseCacheToFlag expands the --cache-to shorthand "<ref>[,mode=max]" into a registry-typed CacheOptionsEntry.
+func parseCacheToFlag(s string) (client.CacheOptionsEntry, error) {
+	if strings.Contains(s, "type=") {
+		return parseExportCacheCSV(s)
+	}
+	csvReader := csv.NewReader(strings.NewReader(s))
+	fields, err := csvReader.Read()
+	if err != nil {
+		return client.CacheOptionsEntry{}, err
+	}
+	if len(fields) == 0 || fields[0] == "" {
+		return client.CacheOptionsEntry{}, errors.New("--cache-to requires a ref")
+	}
+	rewritten := append([]string{"type=registry", "ref=" + fields[0]}, fields[1:]...)
+	return parseExportCacheCSV(strings.Join(rewritten, ","))
+}
+
+// resolveCacheLocalDirs resolves the src/dest directories of any type=local entries to absolute paths and session names.
+func resolveCacheLocalDirs(cacheExports, cacheImports []client.CacheOptionsEntry) (map[string]string, error) {
+	dirs := map[string]string{}
+	if err := resolveCacheLocalDirsForEntries(cacheExports, "export", "dest", dirs); err != nil {
+		return nil, err
+	}
+	if err := resolveCacheLocalDirsForEntries(cacheImports, "import", "src", dirs); err != nil {
+		return nil, err
+	}
+	return dirs, nil
+}
+
+func resolveCacheLocalDirsForEntries(entries []client.CacheOptionsEntry, kind, pathAttr string, dirs map[string]string) error {
+	for i, ce := range entries {
+		if ce.Type != "local" {
+			continue
+		}
+		dir, ok := ce.Attrs[pathAttr]
+		if !ok {
+			return errors.Errorf("--%s-cache type=local requires %s=<dir>", kind, pathAttr)
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return errors.Wrapf(err, "invalid --%s-cache directory %s", kind, dir)
+		}
+		name := fmt.Sprintf("cache-%s-%d", kind, i)
+		entries[i].Attrs["name"] = name
+		delete(entries[i].Attrs, pathAttr)
+		dirs[name] = abs
+	}
+	return nil
+}
+
+// parseBuildContexts parses --build-context name=value entries into LocalDirs and FrontendAttrs for the frontend.
+func parseBuildContexts(inp []string) (map[string]string, map[string]string, error) {
+	localDirs := map[string]string{}
+	frontendAttrs := map[string]string{}
+	for _, v := range inp {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, errors.Errorf("invalid build-context %q, expected name=value", v)
+		}
+		name, value := parts[0], parts[1]
+		switch {
+		case strings.HasPrefix(value, "docker-image://"), strings.HasPrefix(value, "oci-layout://"):
+			frontendAttrs["context:"+name] = value
+		case strings.HasPrefix(value, "https://"), strings.HasPrefix(value, "http://"):
+			frontendAttrs["context:"+name] = "git://" + strings.TrimPrefix(strings.TrimPrefix(value, "https://"), "http://")
+		default:
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid build-context directory %s", value)
+			}
+			localDirs[name] = abs
+			frontendAttrs["context:"+name] = "local:" + name
+		}
+	}
+	return localDirs, frontendAttrs, nil
+}
+
 func attrMap(sl []string) (map[string]string, error) {
 	m := map[string]string{}
 	for _, v := range sl {
@@ -408,53 +669,90 @@ func attrMap(sl []string) (map[string]string, error) {
 }
 
 func parseSecretSpecs(sl []string) (session.Attachable, error) {
-	fs := make([]secretsprovider.FileSource, 0, len(sl))
+	fileSources := make([]secretsprovider.FileSource, 0, len(sl))
+	envSources := map[string]string{} // secret id -> env var name
 	for _, v := range sl {
 		s, err := parseSecret(v)
 		if err != nil {
 			return nil, err
 		}
-		fs = append(fs, *s)
+		switch s.Type {
+		case "file":
+			fileSources = append(fileSources, secretsprovider.FileSource{ID: s.ID, FilePath: s.FilePath})
+		case "env":
+			envSources[s.ID] = s.Env
+		}
 	}
-	store, err := secretsprovider.NewFileStore(fs)
+	fileStore, err := secretsprovider.NewFileStore(fileSources)
 	if err != nil {
 		return nil, err
 	}
-	return secretsprovider.NewSecretProvider(store), nil
+	if len(envSources) == 0 {
+		return secretsprovider.NewSecretProvider(fileStore), nil
+	}
+	return secretsprovider.NewSecretProvider(newMultiSource(fileStore, newEnvSource(envSources))), nil
+}
+
+// secretSpec is the parsed form of a --secret flag value.
+type secretSpec struct {
+	Type     string // "file" or "env"
+	ID       string
+	FilePath string
+	Env      string
 }
 
-func parseSecret(value string) (*secretsprovider.FileSource, error) {
+func parseSecret(value string) (*secretSpec, error) {
 	csvReader := csv.NewReader(strings.NewReader(value))
 	fields, err := csvReader.Read()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse csv secret")
 	}
 
-	fs := secretsprovider.FileSource{}
-
+	spec := secretSpec{}
 	for _, field := range fields {
 		parts := strings.SplitN(field, "=", 2)
-		key := strings.ToLower(parts[0])
-
 		if len(parts) != 2 {
 			return nil, errors.Errorf("invalid field '%s' must be a key=value pair", field)
 		}
-
+		key := strings.ToLower(parts[0])
 		value := parts[1]
 		switch key {
 		case "type":
-			if value != "file" {
+			if value != "file" && value != "env" {
 				return nil, errors.Errorf("unsupported secret type %q", value)
 			}
+			spec.Type = value
 		case "id":
-			fs.ID = value
+			spec.ID = value
 		case "source", "src":
-			fs.FilePath = value
+			spec.FilePath = value
+		case "env":
+			spec.Env = value
 		default:
 			return nil, errors.Errorf("unexpected key '%s' in '%s'", key, field)
 		}
 	}
-	return &fs, nil
+
+	if spec.Type == "" {
+		switch {
+		case spec.Env != "":
+			spec.Type = "env"
+		case spec.FilePath != "":
+			spec.Type = "file"
+		default:
+			// Bare `--secret id=FOO` shorthand: read from the identically
+			// named environment variable instead of requiring src=<path>.
+			spec.Type = "env"
+			spec.Env = spec.ID
+		}
+	}
+	if spec.Type == "env" && spec.Env == "" {
+		spec.Env = spec.ID
+	}
+	if spec.Type == "file" && spec.FilePath == "" {
+		return nil, errors.Errorf("secret '%s' requires src=<path>", spec.ID)
+	}
+	return &spec, nil
 }
 
 // resolveExporterOutput returns at most either one of io.WriteCloser (single file) or a string (directory path).
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+)
+
+func TestFanOutSolveStatusDeadSinkDoesNotWedgeOthers(t *testing.T) {
+	ch := make(chan *client.SolveStatus)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	outs := fanOutSolveStatus(ctx, ch, 2)
+	live, dead := outs[0], outs[1]
+
+	done := make(chan struct{})
+	var received []*client.SolveStatus
+	go func() {
+		for s := range live {
+			received = append(received, s)
+		}
+		close(done)
+	}()
+
+	// dead never reads, simulating a sink that returned early (e.g. an
+	// invalid --progress value).
+	s := &client.SolveStatus{}
+	select {
+	case ch <- s:
+	case <-time.After(time.Second):
+		t.Fatal("producer blocked sending to fanOutSolveStatus")
+	}
+
+	cancel()
+	close(ch)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("live sink never observed channel close after ctx cancellation")
+	}
+}
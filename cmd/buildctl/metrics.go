@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// metricsPushTimeout bounds the final push to the pushgateway.
+const metricsPushTimeout = 15 * time.Second
+
+// vertexAgg tracks the latest state seen for a single vertex.
+type vertexAgg struct {
+	cached    bool
+	started   *time.Time
+	completed *time.Time
+}
+
+// metricsAgg holds the stats aggregateMetricsStream derives from a solve status stream.
+type metricsAgg struct {
+	vertexCount   int
+	cacheHits     int
+	totalDuration time.Duration
+	totalBytes    int64
+}
+
+// aggregateMetricsStream drains ch, tracking the latest state per vertex and
+// per status ID so retransmitted events don't get double-counted.
+func aggregateMetricsStream(ch chan *client.SolveStatus) metricsAgg {
+	vertices := map[string]*vertexAgg{}
+	// statusBytes tracks the last Current value per vertex/status ID pair.
+	statusBytes := map[string]int64{}
+
+	for s := range ch {
+		for _, v := range s.Vertexes {
+			key := v.Digest.String()
+			va, ok := vertices[key]
+			if !ok {
+				va = &vertexAgg{}
+				vertices[key] = va
+			}
+			va.cached = v.Cached
+			if v.Started != nil {
+				va.started = v.Started
+			}
+			if v.Completed != nil {
+				va.completed = v.Completed
+			}
+		}
+		for _, st := range s.Statuses {
+			statusBytes[fmt.Sprintf("%s:%s", st.Vertex, st.ID)] = st.Current
+		}
+	}
+
+	var agg metricsAgg
+	agg.vertexCount = len(vertices)
+	for _, va := range vertices {
+		if va.cached {
+			agg.cacheHits++
+		}
+		if va.started != nil && va.completed != nil {
+			agg.totalDuration += va.completed.Sub(*va.started)
+		}
+	}
+	for _, b := range statusBytes {
+		agg.totalBytes += b
+	}
+	return agg
+}
+
+// pushMetrics aggregates vertex/byte/duration stats from the solve status stream and pushes them to a Prometheus pushgateway.
+func pushMetrics(url string, ch chan *client.SolveStatus) error {
+	agg := aggregateMetricsStream(ch)
+	if agg.vertexCount == 0 {
+		return nil
+	}
+
+	vertexCountGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "buildkit_build_vertex_count",
+		Help: "Number of distinct vertices executed in the build",
+	})
+	cacheHitRatioGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "buildkit_build_cache_hit_ratio",
+		Help: "Fraction of vertices served from cache",
+	})
+	durationGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "buildkit_build_duration_seconds",
+		Help: "Sum of vertex execution durations",
+	})
+	bytesGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "buildkit_build_transferred_bytes",
+		Help: "Total bytes transferred while executing the build",
+	})
+
+	vertexCountGauge.Set(float64(agg.vertexCount))
+	cacheHitRatioGauge.Set(float64(agg.cacheHits) / float64(agg.vertexCount))
+	durationGauge.Set(agg.totalDuration.Seconds())
+	bytesGauge.Set(float64(agg.totalBytes))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(vertexCountGauge, cacheHitRatioGauge, durationGauge, bytesGauge)
+
+	httpClient := &http.Client{Timeout: metricsPushTimeout}
+	return push.New(url, "buildctl").Gatherer(reg).Client(httpClient).Push()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestAggregateMetricsStreamDoesNotDoubleCountRetransmittedVertices(t *testing.T) {
+	dgst := digest.FromString("v1")
+	t0 := time.Unix(0, 0)
+	t1 := t0.Add(5 * time.Second)
+
+	ch := make(chan *client.SolveStatus, 3)
+	ch <- &client.SolveStatus{Vertexes: []*client.Vertex{{Digest: dgst, Started: &t0}}}
+	ch <- &client.SolveStatus{Vertexes: []*client.Vertex{{Digest: dgst, Started: &t0}}}
+	ch <- &client.SolveStatus{Vertexes: []*client.Vertex{{Digest: dgst, Started: &t0, Completed: &t1}}}
+	close(ch)
+
+	agg := aggregateMetricsStream(ch)
+	if agg.vertexCount != 1 {
+		t.Fatalf("expected 1 vertex, got %d", agg.vertexCount)
+	}
+	if agg.totalDuration != 5*time.Second {
+		t.Fatalf("expected duration counted once (5s), got %s", agg.totalDuration)
+	}
+}
+
+func TestAggregateMetricsStreamTakesFinalCumulativeBytes(t *testing.T) {
+	dgst := digest.FromString("v1")
+
+	ch := make(chan *client.SolveStatus, 3)
+	ch <- &client.SolveStatus{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 10}}}
+	ch <- &client.SolveStatus{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 50}}}
+	ch <- &client.SolveStatus{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 100}}}
+	close(ch)
+
+	agg := aggregateMetricsStream(ch)
+	if agg.totalBytes != 100 {
+		t.Fatalf("expected the final cumulative Current (100) rather than a sum of all emissions (160), got %d", agg.totalBytes)
+	}
+}
+
+func TestAggregateMetricsStreamCountsCacheHits(t *testing.T) {
+	ch := make(chan *client.SolveStatus, 2)
+	ch <- &client.SolveStatus{Vertexes: []*client.Vertex{{Digest: digest.FromString("v1"), Cached: true}}}
+	ch <- &client.SolveStatus{Vertexes: []*client.Vertex{{Digest: digest.FromString("v2"), Cached: false}}}
+	close(ch)
+
+	agg := aggregateMetricsStream(ch)
+	if agg.vertexCount != 2 || agg.cacheHits != 1 {
+		t.Fatalf("expected 1 cache hit out of 2 vertices, got %d/%d", agg.cacheHits, agg.vertexCount)
+	}
+}
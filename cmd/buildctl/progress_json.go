@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/moby/buildkit/client"
+)
+
+// jsonProgressSchemaVersion is bumped whenever the shape of jsonProgressEvent changes.
+const jsonProgressSchemaVersion = 1
+
+// jsonProgressEvent is the --progress=json wire format: one line per client.SolveStatus event
+// that carries vertexes or logs; events with neither (e.g. status-only updates) are not written.
+type jsonProgressEvent struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	Vertexes      []jsonProgressVertex `json:"vertexes,omitempty"`
+	Logs          []jsonProgressLog    `json:"logs,omitempty"`
+}
+
+type jsonProgressVertex struct {
+	Digest    string     `json:"digest"`
+	Name      string     `json:"name"`
+	CacheHit  bool       `json:"cacheHit"`
+	Error     string     `json:"error,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+type jsonProgressLog struct {
+	Vertex    string    `json:"vertex"`
+	Stream    int       `json:"stream"`
+	Data      string    `json:"data"` // base64-encoded
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func writeJSONProgress(w io.Writer, ch chan *client.SolveStatus) error {
+	enc := json.NewEncoder(w)
+	for s := range ch {
+		ev := jsonProgressEvent{SchemaVersion: jsonProgressSchemaVersion}
+		for _, v := range s.Vertexes {
+			ev.Vertexes = append(ev.Vertexes, jsonProgressVertex{
+				Digest:    v.Digest.String(),
+				Name:      v.Name,
+				CacheHit:  v.Cached,
+				Error:     v.Error,
+				Started:   v.Started,
+				Completed: v.Completed,
+			})
+		}
+		for _, l := range s.Logs {
+			ev.Logs = append(ev.Logs, jsonProgressLog{
+				Vertex:    l.Vertex.String(),
+				Stream:    l.Stream,
+				Data:      base64.StdEncoding.EncodeToString(l.Data),
+				Timestamp: l.Timestamp,
+			})
+		}
+		if len(ev.Vertexes) == 0 && len(ev.Logs) == 0 {
+			continue
+		}
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/pkg/errors"
+)
+
+// envSource resolves secret contents from environment variables.
+type envSource struct {
+	// vars maps secret ID to environment variable name.
+	vars map[string]string
+}
+
+func newEnvSource(vars map[string]string) secretsprovider.Source {
+	return &envSource{vars: vars}
+}
+
+func (s *envSource) GetSecret(ctx context.Context, id string) ([]byte, error) {
+	envName, ok := s.vars[id]
+	if !ok {
+		return nil, errors.Wrapf(secretsprovider.ErrNotFound, "unknown secret: %s", id)
+	}
+	v, ok := os.LookupEnv(envName)
+	if !ok {
+		return nil, errors.Wrapf(secretsprovider.ErrNotFound, "environment variable %s for secret %s is not set", envName, id)
+	}
+	return []byte(v), nil
+}
+
+// multiSource tries each secretsprovider.Source in order and returns the first match.
+type multiSource struct {
+	sources []secretsprovider.Source
+}
+
+func newMultiSource(sources ...secretsprovider.Source) secretsprovider.Source {
+	return &multiSource{sources: sources}
+}
+
+func (s *multiSource) GetSecret(ctx context.Context, id string) ([]byte, error) {
+	var lastErr error
+	for _, src := range s.sources {
+		v, err := src.GetSecret(ctx, id)
+		if err == nil {
+			return v, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.Wrapf(secretsprovider.ErrNotFound, "unknown secret: %s", id)
+	}
+	return nil, lastErr
+}
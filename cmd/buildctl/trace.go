@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// writeTrace converts a buffered SolveStatus stream into a single trace document in the requested format.
+func writeTrace(f *os.File, format string, events []*client.SolveStatus) error {
+	spans := buildVertexSpans(events)
+	switch format {
+	case "jaeger":
+		return json.NewEncoder(f).Encode(toJaegerTrace(spans))
+	case "otlp-json":
+		return json.NewEncoder(f).Encode(toOTLPTrace(spans))
+	default:
+		return errors.Errorf("unsupported trace format: %s", format)
+	}
+}
+
+// vertexSpan accumulates everything observed for a single vertex digest.
+type vertexSpan struct {
+	digest    digest.Digest
+	name      string
+	cached    bool
+	errMsg    string
+	started   *time.Time
+	completed *time.Time
+	statuses  []*client.VertexStatus
+	// statusIndex maps a VertexStatus.ID to its slot in statuses.
+	statusIndex map[string]int
+	logs        []*client.VertexLog
+}
+
+func buildVertexSpans(events []*client.SolveStatus) []*vertexSpan {
+	var order []digest.Digest
+	byDigest := map[digest.Digest]*vertexSpan{}
+
+	get := func(dgst digest.Digest) *vertexSpan {
+		sp, ok := byDigest[dgst]
+		if !ok {
+			sp = &vertexSpan{digest: dgst, statusIndex: map[string]int{}}
+			byDigest[dgst] = sp
+			order = append(order, dgst)
+		}
+		return sp
+	}
+
+	for _, ev := range events {
+		for _, v := range ev.Vertexes {
+			sp := get(v.Digest)
+			sp.name = v.Name
+			sp.cached = v.Cached
+			sp.errMsg = v.Error
+			if v.Started != nil {
+				sp.started = v.Started
+			}
+			if v.Completed != nil {
+				sp.completed = v.Completed
+			}
+		}
+		for _, s := range ev.Statuses {
+			sp := get(s.Vertex)
+			if idx, ok := sp.statusIndex[s.ID]; ok {
+				sp.statuses[idx] = s
+			} else {
+				sp.statusIndex[s.ID] = len(sp.statuses)
+				sp.statuses = append(sp.statuses, s)
+			}
+		}
+		for _, l := range ev.Logs {
+			sp := get(l.Vertex)
+			sp.logs = append(sp.logs, l)
+		}
+	}
+
+	spans := make([]*vertexSpan, 0, len(order))
+	for _, dgst := range order {
+		spans = append(spans, byDigest[dgst])
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		si, sj := spans[i].started, spans[j].started
+		if si == nil || sj == nil {
+			return false
+		}
+		return si.Before(*sj)
+	})
+	return spans
+}
+
+func traceBounds(spans []*vertexSpan) (time.Time, time.Time) {
+	var start, end time.Time
+	for _, sp := range spans {
+		if sp.started != nil && (start.IsZero() || sp.started.Before(start)) {
+			start = *sp.started
+		}
+		if sp.completed != nil && sp.completed.After(end) {
+			end = *sp.completed
+		}
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	if end.Before(start) {
+		end = start
+	}
+	return start, end
+}
+
+// spanID returns a stable 8-byte span ID derived from key.
+func spanID(key string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// traceID returns a stable 16-byte trace ID for the whole build.
+func traceID(rootID string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("trace:" + rootID))
+	return rootID + hex.EncodeToString(h.Sum(nil))
+}
+
+func logStream(stream int) string {
+	if stream == 2 {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// --- jaeger ("Upload trace" JSON) ---
+
+type jaegerTraceFile struct {
+	Data []jaegerTrace `json:"data"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references,omitempty"`
+	StartTime     int64             `json:"startTime"` // microseconds since epoch
+	Duration      int64             `json:"duration"`  // microseconds
+	Tags          []jaegerTag       `json:"tags,omitempty"`
+	Logs          []jaegerLog       `json:"logs,omitempty"`
+	ProcessID     string            `json:"processID"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerTag struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64       `json:"timestamp"`
+	Fields    []jaegerTag `json:"fields"`
+}
+
+type jaegerProcess struct {
+	ServiceName string      `json:"serviceName"`
+	Tags        []jaegerTag `json:"tags"`
+}
+
+func toJaegerTrace(spans []*vertexSpan) jaegerTraceFile {
+	start, end := traceBounds(spans)
+	rootID := spanID("root")
+	tid := traceID(rootID)
+
+	root := jaegerSpan{
+		TraceID:       tid,
+		SpanID:        rootID,
+		OperationName: "solve",
+		StartTime:     start.UnixNano() / int64(time.Microsecond),
+		Duration:      end.Sub(start).Microseconds(),
+		ProcessID:     "p1",
+	}
+	jspans := []jaegerSpan{root}
+
+	for _, sp := range spans {
+		sid := spanID(sp.digest.String())
+		sStart, sEnd := start, end
+		if sp.started != nil {
+			sStart = *sp.started
+		}
+		if sp.completed != nil {
+			sEnd = *sp.completed
+		} else {
+			sEnd = sStart
+		}
+
+		tags := []jaegerTag{
+			{Key: "cache.hit", Type: "bool", Value: sp.cached},
+			{Key: "vertex.digest", Type: "string", Value: sp.digest.String()},
+		}
+		if sp.errMsg != "" {
+			tags = append(tags, jaegerTag{Key: "error", Type: "bool", Value: true})
+			tags = append(tags, jaegerTag{Key: "error.message", Type: "string", Value: sp.errMsg})
+		}
+
+		js := jaegerSpan{
+			TraceID:       tid,
+			SpanID:        sid,
+			OperationName: sp.name,
+			References:    []jaegerReference{{RefType: "CHILD_OF", TraceID: tid, SpanID: rootID}},
+			StartTime:     sStart.UnixNano() / int64(time.Microsecond),
+			Duration:      sEnd.Sub(sStart).Microseconds(),
+			Tags:          tags,
+			ProcessID:     "p1",
+		}
+		for _, l := range sp.logs {
+			js.Logs = append(js.Logs, jaegerLog{
+				Timestamp: l.Timestamp.UnixNano() / int64(time.Microsecond),
+				Fields: []jaegerTag{
+					{Key: "stream", Type: "string", Value: logStream(l.Stream)},
+					{Key: "message", Type: "string", Value: string(l.Data)},
+				},
+			})
+		}
+		jspans = append(jspans, js)
+
+		for i, st := range sp.statuses {
+			stid := spanID(fmt.Sprintf("%s:status:%d", sp.digest, i))
+			stStart, stEnd := sStart, sEnd
+			if st.Started != nil {
+				stStart = *st.Started
+			}
+			if st.Completed != nil {
+				stEnd = *st.Completed
+			}
+			jspans = append(jspans, jaegerSpan{
+				TraceID:       tid,
+				SpanID:        stid,
+				OperationName: st.Name,
+				References:    []jaegerReference{{RefType: "CHILD_OF", TraceID: tid, SpanID: sid}},
+				StartTime:     stStart.UnixNano() / int64(time.Microsecond),
+				Duration:      stEnd.Sub(stStart).Microseconds(),
+				Tags: []jaegerTag{
+					{Key: "progress.current", Type: "int64", Value: st.Current},
+					{Key: "progress.total", Type: "int64", Value: st.Total},
+				},
+				ProcessID: "p1",
+			})
+		}
+	}
+
+	return jaegerTraceFile{
+		Data: []jaegerTrace{
+			{
+				TraceID: tid,
+				Spans:   jspans,
+				Processes: map[string]jaegerProcess{
+					"p1": {ServiceName: "buildctl"},
+				},
+			},
+		},
+	}
+}
+
+// --- otlp-json (OTLP/HTTP ExportTraceServiceRequest, JSON encoding) ---
+
+type otlpTraceFile struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKV `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpKV    `json:"attributes,omitempty"`
+	Events            []otlpEvent `json:"events,omitempty"`
+	Status            otlpStatus  `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string   `json:"timeUnixNano"`
+	Name         string   `json:"name"`
+	Attributes   []otlpKV `json:"attributes,omitempty"`
+}
+
+type otlpKV struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 1 ok, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+func otlpStringAttr(key, value string) otlpKV {
+	v := value
+	return otlpKV{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpBoolAttr(key string, value bool) otlpKV {
+	v := value
+	return otlpKV{Key: key, Value: otlpValue{BoolValue: &v}}
+}
+
+func otlpIntAttr(key string, value int64) otlpKV {
+	v := fmt.Sprintf("%d", value)
+	return otlpKV{Key: key, Value: otlpValue{IntValue: &v}}
+}
+
+func toOTLPTrace(spans []*vertexSpan) otlpTraceFile {
+	start, end := traceBounds(spans)
+	rootID := spanID("root")
+	tid := traceID(rootID)
+
+	oSpans := []otlpSpan{
+		{
+			TraceID:           tid,
+			SpanID:            rootID,
+			Name:              "solve",
+			StartTimeUnixNano: fmt.Sprintf("%d", start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprintf("%d", end.UnixNano()),
+			Status:            otlpStatus{Code: 1},
+		},
+	}
+
+	for _, sp := range spans {
+		sid := spanID(sp.digest.String())
+		sStart, sEnd := start, end
+		if sp.started != nil {
+			sStart = *sp.started
+		}
+		if sp.completed != nil {
+			sEnd = *sp.completed
+		} else {
+			sEnd = sStart
+		}
+
+		status := otlpStatus{Code: 1}
+		attrs := []otlpKV{
+			otlpBoolAttr("cache.hit", sp.cached),
+			otlpStringAttr("vertex.digest", sp.digest.String()),
+		}
+		if sp.errMsg != "" {
+			status = otlpStatus{Code: 2, Message: sp.errMsg}
+		}
+
+		var events []otlpEvent
+		for _, l := range sp.logs {
+			events = append(events, otlpEvent{
+				TimeUnixNano: fmt.Sprintf("%d", l.Timestamp.UnixNano()),
+				Name:         "log",
+				Attributes: []otlpKV{
+					otlpStringAttr("stream", logStream(l.Stream)),
+					otlpStringAttr("message", string(l.Data)),
+				},
+			})
+		}
+
+		oSpans = append(oSpans, otlpSpan{
+			TraceID:           tid,
+			SpanID:            sid,
+			ParentSpanID:      rootID,
+			Name:              sp.name,
+			StartTimeUnixNano: fmt.Sprintf("%d", sStart.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprintf("%d", sEnd.UnixNano()),
+			Attributes:        attrs,
+			Events:            events,
+			Status:            status,
+		})
+
+		for i, st := range sp.statuses {
+			stid := spanID(fmt.Sprintf("%s:status:%d", sp.digest, i))
+			stStart, stEnd := sStart, sEnd
+			if st.Started != nil {
+				stStart = *st.Started
+			}
+			if st.Completed != nil {
+				stEnd = *st.Completed
+			}
+			oSpans = append(oSpans, otlpSpan{
+				TraceID:           tid,
+				SpanID:            stid,
+				ParentSpanID:      sid,
+				Name:              st.Name,
+				StartTimeUnixNano: fmt.Sprintf("%d", stStart.UnixNano()),
+				EndTimeUnixNano:   fmt.Sprintf("%d", stEnd.UnixNano()),
+				Attributes: []otlpKV{
+					otlpIntAttr("progress.current", st.Current),
+					otlpIntAttr("progress.total", st.Total),
+				},
+				Status: otlpStatus{Code: 1},
+			})
+		}
+	}
+
+	return otlpTraceFile{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpKV{otlpStringAttr("service.name", "buildctl")},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "github.com/moby/buildkit/cmd/buildctl"},
+						Spans: oSpans,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestBuildVertexSpansDedupesStatusesByID(t *testing.T) {
+	dgst := digest.FromString("v1")
+	t0 := time.Unix(0, 0)
+	t1 := t0.Add(time.Second)
+
+	events := []*client.SolveStatus{
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 10, Started: &t0}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 50, Started: &t0}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Current: 100, Started: &t0, Completed: &t1}}},
+	}
+
+	spans := buildVertexSpans(events)
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	sp := spans[0]
+	if len(sp.statuses) != 1 {
+		t.Fatalf("expected the 3 retransmissions of status %q to collapse into 1 entry, got %d", "copy", len(sp.statuses))
+	}
+	if sp.statuses[0].Current != 100 {
+		t.Fatalf("expected the final Current value 100, got %d", sp.statuses[0].Current)
+	}
+}
+
+func TestBuildVertexSpansDedupesVerticesByDigest(t *testing.T) {
+	dgst := digest.FromString("v1")
+	events := []*client.SolveStatus{
+		{Vertexes: []*client.Vertex{{Digest: dgst, Name: "step 1"}}},
+		{Vertexes: []*client.Vertex{{Digest: dgst, Name: "step 1", Cached: true}}},
+	}
+
+	spans := buildVertexSpans(events)
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if !spans[0].cached {
+		t.Fatalf("expected the later retransmission's Cached=true to win")
+	}
+}
+
+func TestToJaegerTraceIncludesOneSpanPerStatus(t *testing.T) {
+	dgst := digest.FromString("v1")
+	t0 := time.Unix(0, 0)
+	events := []*client.SolveStatus{
+		{Vertexes: []*client.Vertex{{Digest: dgst, Name: "step 1", Started: &t0}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Name: "copy", Current: 10}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Name: "copy", Current: 20}}},
+	}
+
+	trace := toJaegerTrace(buildVertexSpans(events))
+	if len(trace.Data) != 1 {
+		t.Fatalf("expected 1 trace, got %d", len(trace.Data))
+	}
+	// root span + vertex span + 1 deduped status span
+	if got, want := len(trace.Data[0].Spans), 3; got != want {
+		t.Fatalf("expected %d spans, got %d", want, got)
+	}
+}
+
+func TestToOTLPTraceIncludesOneSpanPerStatus(t *testing.T) {
+	dgst := digest.FromString("v1")
+	t0 := time.Unix(0, 0)
+	events := []*client.SolveStatus{
+		{Vertexes: []*client.Vertex{{Digest: dgst, Name: "step 1", Started: &t0}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Name: "copy", Current: 10}}},
+		{Statuses: []*client.VertexStatus{{ID: "copy", Vertex: dgst, Name: "copy", Current: 20}}},
+	}
+
+	trace := toOTLPTrace(buildVertexSpans(events))
+	if len(trace.ResourceSpans) != 1 || len(trace.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected trace shape: %+v", trace)
+	}
+	if got, want := len(trace.ResourceSpans[0].ScopeSpans[0].Spans), 3; got != want {
+		t.Fatalf("expected %d spans, got %d", want, got)
+	}
+}